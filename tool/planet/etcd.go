@@ -20,9 +20,43 @@ import (
 	"github.com/gravitational/planet/lib/box"
 	"github.com/gravitational/trace"
 	ps "github.com/mitchellh/go-ps"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	backupLastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "last_successful_backup_timestamp",
+		Help: "Unix timestamp of the last successful etcd backup.",
+	})
+	backupDurationSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_duration_seconds",
+		Help: "Duration in seconds of the last scheduled etcd backup, including retries.",
+	})
+	backupFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "backup_failures_total",
+		Help: "Total number of scheduled etcd backups that failed after all retries.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(backupLastSuccessTimestamp, backupDurationSeconds, backupFailuresTotal)
+}
+
+const (
+	// EtcdBackupDefaultInterval is the default period between scheduled etcd backups.
+	EtcdBackupDefaultInterval = 1 * time.Hour
+	// EtcdBackupDefaultMaxBackups is the default number of snapshots retained by
+	// etcdBackupScheduler.
+	EtcdBackupDefaultMaxBackups = 6
+	// EtcdBackupMaxRetries is the number of attempts etcdBackupScheduler makes for a
+	// single scheduled snapshot before giving up and waiting for the next interval.
+	EtcdBackupMaxRetries = 3
+	// EtcdBackupRetryBaseDelay is the initial delay between retries of a failed
+	// scheduled backup; it doubles with each subsequent attempt.
+	EtcdBackupRetryBaseDelay = 5 * time.Second
+)
+
 // etcdPromote promotes running etcd proxy to a full member; does nothing if it's already
 // running in proxy mode.
 //
@@ -107,6 +141,11 @@ func etcdInit() error {
 	}
 	log.Info("Desired etcd version: ", desiredVersion)
 
+	// Resume a downgrade left in flight by a previous process before reading
+	// DefaultEtcdCurrentVersionFile below, so that if it completes, the symlinks this function
+	// writes reflect the downgrade target rather than the stale pre-downgrade version.
+	resumePendingDowngrade(context.Background())
+
 	currentVersion, _, err := readEtcdVersion(DefaultEtcdCurrentVersionFile)
 	if err != nil {
 		if !trace.IsNotFound(err) {
@@ -178,18 +217,14 @@ func etcdInit() error {
 	return nil
 }
 
+// etcdBackup streams a snapshot into backupFile, which the caller (etcdBackupToStore) always
+// points at a freshly created named pipe: backupFile must already exist as exactly the inode
+// the backup library should open for writing, so unlike most paths in this file, it must not
+// be stat'd or removed first.
 func etcdBackup(backupFile string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), EtcdUpgradeTimeout)
 	defer cancel()
 
-	// If a backup from a previous upgrade exists, clean it up
-	if _, err := os.Stat(backupFile); err == nil {
-		err = os.Remove(backupFile)
-		if err != nil {
-			return trace.Wrap(err)
-		}
-	}
-
 	backupConf := backup.BackupConfig{
 		EtcdConfig: etcdconf.Config{
 			Endpoints: []string{DefaultEtcdEndpoints},
@@ -210,6 +245,179 @@ func etcdBackup(backupFile string) error {
 	return nil
 }
 
+// BackupSchedulerConfig configures the long-running periodic backup controller started by
+// etcdBackupScheduler.
+type BackupSchedulerConfig struct {
+	// StoreURL addresses where snapshots are written, in the form understood by
+	// NewBackupStore: a local path (or "file://" URL) or an "s3://", "gs://" or "azblob://"
+	// object-store URL.
+	StoreURL string
+	// Interval is the period between consecutive snapshots.
+	Interval time.Duration
+	// MaxBackups caps the number of snapshots retained in the store; the oldest are pruned
+	// once a new snapshot succeeds.
+	MaxBackups int
+}
+
+// checkAndSetDefaults validates the scheduler configuration and fills in defaults for
+// fields left unset.
+func (r *BackupSchedulerConfig) checkAndSetDefaults() error {
+	if r.StoreURL == "" {
+		return trace.BadParameter("backup store URL is required")
+	}
+	if r.Interval <= 0 {
+		r.Interval = EtcdBackupDefaultInterval
+	}
+	if r.MaxBackups <= 0 {
+		r.MaxBackups = EtcdBackupDefaultMaxBackups
+	}
+	return nil
+}
+
+// etcdBackupScheduler runs a long-lived loop that takes periodic etcd snapshots into the
+// backup store addressed by config.StoreURL, retaining only the newest config.MaxBackups
+// snapshots, until ctx is cancelled.
+//
+// On start, rather than taking a snapshot immediately, the next run is scheduled based on
+// the time encoded in the name of the newest existing snapshot (see nextBackupDelay), so a
+// planet restart doesn't cause a burst of
+// backups outside the configured cadence.
+func etcdBackupScheduler(ctx context.Context, config BackupSchedulerConfig) error {
+	if err := config.checkAndSetDefaults(); err != nil {
+		return trace.Wrap(err)
+	}
+
+	store, err := NewBackupStore(ctx, config.StoreURL)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	delay, err := nextBackupDelay(ctx, store, config.Interval)
+	if err != nil {
+		log.WithError(err).Warn("Failed to inspect existing etcd backups, scheduling one now.")
+		delay = 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		case <-timer.C:
+			if err := runScheduledBackup(ctx, store, config); err != nil {
+				log.WithError(err).Warn("Scheduled etcd backup failed.")
+			}
+			timer.Reset(config.Interval)
+		}
+	}
+}
+
+// nextBackupDelay computes how long to wait before the next scheduled snapshot, based on
+// the name of the newest existing snapshot in store, which encodes the time it was taken.
+// If no snapshot exists, the first backup runs immediately.
+func nextBackupDelay(ctx context.Context, store BackupStore, interval time.Duration) (time.Duration, error) {
+	names, err := store.List(ctx)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+
+	taken, err := backupSnapshotTime(names[len(names)-1])
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+
+	elapsed := time.Since(taken)
+	if elapsed >= interval {
+		return 0, nil
+	}
+	return interval - elapsed, nil
+}
+
+// runScheduledBackup takes a single snapshot with retry/backoff, uploads it to store,
+// records its outcome in the backup_* metrics, and prunes old snapshots on success.
+func runScheduledBackup(ctx context.Context, store BackupStore, config BackupSchedulerConfig) error {
+	name := fmt.Sprintf("etcd-backup-%v.bak", time.Now().UTC().Format("20060102-150405"))
+
+	start := time.Now()
+	err := retryWithBackoff(ctx, EtcdBackupMaxRetries, func() error {
+		return etcdBackupToStore(ctx, config.StoreURL, name)
+	})
+	backupDurationSeconds.Set(time.Since(start).Seconds())
+	if err != nil {
+		backupFailuresTotal.Inc()
+		return trace.Wrap(err, "failed to take scheduled etcd backup")
+	}
+
+	backupLastSuccessTimestamp.Set(float64(time.Now().Unix()))
+	log.Infof("Scheduled etcd backup complete: %v", name)
+
+	return trace.Wrap(pruneOldBackups(ctx, store, config.MaxBackups))
+}
+
+// retryWithBackoff invokes fn up to maxAttempts times, waiting with exponential backoff
+// between transient failures.
+func retryWithBackoff(ctx context.Context, maxAttempts int, fn func() error) error {
+	var err error
+	backoff := EtcdBackupRetryBaseDelay
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		log.WithError(err).Warnf("etcd backup attempt %v/%v failed.", attempt, maxAttempts)
+		if attempt == maxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return trace.Wrap(err)
+}
+
+// pruneOldBackups deletes the oldest snapshots in store until at most maxBackups remain.
+// Retention is delegated entirely to BackupStore.List/Delete so the scheduler behaves the
+// same regardless of whether it's writing to local disk or an object store.
+func pruneOldBackups(ctx context.Context, store BackupStore, maxBackups int) error {
+	names, err := store.List(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(names) <= maxBackups {
+		return nil
+	}
+	for _, name := range names[:len(names)-maxBackups] {
+		if err := store.Delete(ctx, name); err != nil {
+			return trace.Wrap(err)
+		}
+		log.Infof("Removed old etcd backup: %v", name)
+	}
+	return nil
+}
+
+// backupSnapshotNameLayout is the timestamp layout etcdBackupScheduler encodes into each
+// snapshot's name, so nextBackupDelay can recover when it was taken without relying on
+// filesystem mtime, which object stores don't expose consistently.
+const backupSnapshotNameLayout = "20060102-150405"
+
+// backupSnapshotTime parses the timestamp encoded in a scheduled snapshot's name, as
+// produced by runScheduledBackup.
+func backupSnapshotTime(name string) (time.Time, error) {
+	name = strings.TrimPrefix(name, "etcd-backup-")
+	name = strings.TrimSuffix(name, ".bak")
+	t, err := time.Parse(backupSnapshotNameLayout, name)
+	if err != nil {
+		return time.Time{}, trace.Wrap(err, "unexpected etcd backup name %q", name)
+	}
+	return t, nil
+}
+
 // etcdDisable disables etcd on this machine
 // Used during upgrades
 func etcdDisable(upgradeService bool) error {
@@ -245,7 +453,12 @@ func etcdEnable(upgradeService bool) error {
 
 // etcdUpgrade upgrades / rollbacks the etcd upgrade
 // the procedure is basically the same for an upgrade or rollback, just with some paths reversed
-func etcdUpgrade(rollback bool) error {
+//
+// targetVersion pins the upgrade to a specific version, as needed by a single hop of the
+// table-driven migrator (see etcd_migrate.go), where the desired version is the hop's `to`
+// rather than planet's bundled release. If targetVersion is empty, the desired version is
+// read from DefaultPlanetReleaseFile, matching the single-step whole-release upgrade.
+func etcdUpgrade(rollback bool, targetVersion string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), EtcdUpgradeTimeout)
 	defer cancel()
 	log.Info("Updating etcd")
@@ -277,9 +490,12 @@ func etcdUpgrade(rollback bool) error {
 	// In order to upgrade in a re-entrant way
 	// we need to make sure that if the upgrade or rollback is repeated
 	// that it skips anything that has been done on a previous run, and continues anything that may have failed
-	desiredVersion, _, err := readEtcdVersion(DefaultPlanetReleaseFile)
-	if err != nil {
-		return trace.Wrap(err)
+	desiredVersion := targetVersion
+	if desiredVersion == "" {
+		desiredVersion, _, err = readEtcdVersion(DefaultPlanetReleaseFile)
+		if err != nil {
+			return trace.Wrap(err)
+		}
 	}
 	log.Info("Desired etcd version: ", desiredVersion)
 
@@ -295,9 +511,17 @@ func etcdUpgrade(rollback bool) error {
 	log.Info("Backup etcd version: ", backupVersion)
 
 	if rollback {
-		// in order to rollback, write the backup version as the current version, with no backup version
-		if backupVersion != "" {
-			err = writeEtcdEnvironment(DefaultEtcdCurrentVersionFile, backupVersion, "")
+		// in order to rollback, write the backup version as the current version, with no
+		// backup version. A caller driving a specific hop of the table-driven migrator
+		// (etcd_migrate.go) knows exactly which version to land back on and passes it as
+		// targetVersion; the single-shot `planet etcd upgrade --rollback` caller instead
+		// relies on the backup version recorded by the prior call to etcdUpgrade.
+		rollbackVersion := backupVersion
+		if targetVersion != "" {
+			rollbackVersion = targetVersion
+		}
+		if rollbackVersion != "" {
+			err = writeEtcdEnvironment(DefaultEtcdCurrentVersionFile, rollbackVersion, "")
 			if err != nil {
 				return trace.Wrap(err)
 			}
@@ -322,6 +546,12 @@ func etcdUpgrade(rollback bool) error {
 			}
 		}
 
+		// take a rollbackcopy of the currently-running member before its data directory
+		// is wiped, so operators have a fast local path back via `planet etcd rollback`
+		if _, err := etcdRollbackCopy(ctx, currentVersion); err != nil {
+			log.WithError(err).Warn("Failed to create pre-upgrade rollback copy, continuing upgrade")
+		}
+
 		// wipe data directory of any previous upgrade attempt
 		path := path.Join(getBaseEtcdDir(desiredVersion), "member")
 		err = os.RemoveAll(path)
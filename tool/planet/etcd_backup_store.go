@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	azblob "github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+)
+
+// BackupStore abstracts the location etcd snapshots are written to and read from, so
+// etcdBackup, etcdRestore and etcdBackupScheduler can target local disk or remote object
+// storage through the same interface.
+type BackupStore interface {
+	// Put streams r to the store under name.
+	Put(ctx context.Context, name string, r io.Reader) error
+	// List returns the names of snapshots currently in the store, oldest first.
+	List(ctx context.Context) ([]string, error)
+	// Get opens name for reading. Callers must close the returned reader.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// Delete removes name from the store.
+	Delete(ctx context.Context, name string) error
+}
+
+// NewBackupStore builds the BackupStore addressed by rawURL. The scheme selects the
+// backend: "file://" (or a bare path) for local disk, "s3://bucket/prefix" for S3,
+// "gs://bucket/prefix" for GCS and "azblob://container/prefix" for Azure Blob storage.
+// Remote backends source credentials from the environment or the node's IAM role /
+// workload identity, matching how the rest of planet authenticates to cloud APIs.
+func NewBackupStore(ctx context.Context, rawURL string) (BackupStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		dir := u.Path
+		if dir == "" {
+			dir = u.Opaque
+		}
+		return newFileBackupStore(dir), nil
+	case "s3":
+		return newS3BackupStore(u)
+	case "gs":
+		return newGCSBackupStore(ctx, u)
+	case "azblob":
+		return newAzureBackupStore(u)
+	default:
+		return nil, trace.BadParameter("unsupported backup store scheme %q", u.Scheme)
+	}
+}
+
+// fileBackupStore is a BackupStore backed by a local directory.
+type fileBackupStore struct {
+	dir string
+}
+
+func newFileBackupStore(dir string) *fileBackupStore {
+	return &fileBackupStore{dir: dir}
+}
+
+func (r *fileBackupStore) Put(ctx context.Context, name string, src io.Reader) error {
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	f, err := os.Create(path.Join(r.dir, name))
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	defer f.Close()
+	_, err = io.Copy(f, src)
+	return trace.ConvertSystemError(err)
+}
+
+func (r *fileBackupStore) List(ctx context.Context) ([]string, error) {
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, trace.ConvertSystemError(err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (r *fileBackupStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(path.Join(r.dir, name))
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	return f, nil
+}
+
+func (r *fileBackupStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(path.Join(r.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return trace.ConvertSystemError(err)
+	}
+	return nil
+}
+
+// s3BackupStore is a BackupStore backed by an S3 bucket. Credentials are resolved via the
+// default AWS SDK chain (environment, shared config, EC2/EKS IAM role).
+type s3BackupStore struct {
+	bucket string
+	prefix string
+	client *s3.S3
+}
+
+func newS3BackupStore(u *url.URL) (*s3BackupStore, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &s3BackupStore{
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+		client: s3.New(sess),
+	}, nil
+}
+
+func (r *s3BackupStore) key(name string) string {
+	return path.Join(r.prefix, name)
+}
+
+func (r *s3BackupStore) Put(ctx context.Context, name string, src io.Reader) error {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable}))
+	uploader := s3manager.NewUploader(sess)
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key(name)),
+		Body:   src,
+	})
+	return trace.Wrap(err)
+}
+
+func (r *s3BackupStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	var objects []*s3.Object
+	err := r.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(r.prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].LastModified.Before(*objects[j].LastModified)
+	})
+	for _, obj := range objects {
+		names = append(names, path.Base(aws.StringValue(obj.Key)))
+	}
+	return names, nil
+}
+
+func (r *s3BackupStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := r.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key(name)),
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return out.Body, nil
+}
+
+func (r *s3BackupStore) Delete(ctx context.Context, name string) error {
+	_, err := r.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key(name)),
+	})
+	return trace.Wrap(err)
+}
+
+// gcsBackupStore is a BackupStore backed by a Google Cloud Storage bucket. Credentials are
+// resolved via application default credentials (environment / node workload identity).
+type gcsBackupStore struct {
+	bucket string
+	prefix string
+	client *gcs.Client
+}
+
+func newGCSBackupStore(ctx context.Context, u *url.URL) (*gcsBackupStore, error) {
+	client, err := gcs.NewClient(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &gcsBackupStore{bucket: u.Host, prefix: strings.TrimPrefix(u.Path, "/"), client: client}, nil
+}
+
+func (r *gcsBackupStore) key(name string) string {
+	return path.Join(r.prefix, name)
+}
+
+func (r *gcsBackupStore) Put(ctx context.Context, name string, src io.Reader) error {
+	w := r.client.Bucket(r.bucket).Object(r.key(name)).NewWriter(ctx)
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(w.Close())
+}
+
+func (r *gcsBackupStore) List(ctx context.Context) ([]string, error) {
+	it := r.client.Bucket(r.bucket).Objects(ctx, &gcs.Query{Prefix: r.prefix})
+	type entry struct {
+		name    string
+		updated time.Time
+	}
+	var entries []entry
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		entries = append(entries, entry{name: path.Base(attrs.Name), updated: attrs.Updated})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].updated.Before(entries[j].updated) })
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.name
+	}
+	return names, nil
+}
+
+func (r *gcsBackupStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := r.client.Bucket(r.bucket).Object(r.key(name)).NewReader(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return rc, nil
+}
+
+func (r *gcsBackupStore) Delete(ctx context.Context, name string) error {
+	err := r.client.Bucket(r.bucket).Object(r.key(name)).Delete(ctx)
+	return trace.Wrap(err)
+}
+
+// azureBackupStore is a BackupStore backed by an Azure Blob container. Credentials are a
+// shared key sourced from the AZURE_STORAGE_ACCOUNT / AZURE_STORAGE_KEY environment
+// variables; AZURE_STORAGE_ACCOUNT must be set, and managed identity is not used.
+type azureBackupStore struct {
+	containerURL azblob.ContainerURL
+	prefix       string
+}
+
+func newAzureBackupStore(u *url.URL) (*azureBackupStore, error) {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	if account == "" {
+		return nil, trace.BadParameter("AZURE_STORAGE_ACCOUNT must be set to use an azblob:// backup store")
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(account, os.Getenv("AZURE_STORAGE_KEY"))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+
+	// u is an azblob://container/prefix URL: its host is the container name, not a real
+	// endpoint, so the actual blob service URL has to be built from the account name.
+	endpoint, err := url.Parse(fmt.Sprintf("https://%v.blob.core.windows.net/%v", account, u.Host))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	containerURL := azblob.NewContainerURL(*endpoint, pipeline)
+	return &azureBackupStore{containerURL: containerURL, prefix: strings.TrimPrefix(u.Path, "/")}, nil
+}
+
+func (r *azureBackupStore) key(name string) string {
+	return path.Join(r.prefix, name)
+}
+
+func (r *azureBackupStore) Put(ctx context.Context, name string, src io.Reader) error {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	blockBlobURL := r.containerURL.NewBlockBlobURL(r.key(name))
+	_, err = azblob.UploadBufferToBlockBlob(ctx, data, blockBlobURL, azblob.UploadToBlockBlobOptions{})
+	return trace.Wrap(err)
+}
+
+func (r *azureBackupStore) List(ctx context.Context) ([]string, error) {
+	type entry struct {
+		name     string
+		modified time.Time
+	}
+	var entries []entry
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := r.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: r.prefix})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		for _, blob := range resp.Segment.BlobItems {
+			entries = append(entries, entry{name: path.Base(blob.Name), modified: blob.Properties.LastModified})
+		}
+		marker = resp.NextMarker
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modified.Before(entries[j].modified) })
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.name
+	}
+	return names, nil
+}
+
+func (r *azureBackupStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	blockBlobURL := r.containerURL.NewBlockBlobURL(r.key(name))
+	resp, err := blockBlobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+func (r *azureBackupStore) Delete(ctx context.Context, name string) error {
+	blockBlobURL := r.containerURL.NewBlockBlobURL(r.key(name))
+	_, err := blockBlobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	return trace.Wrap(err)
+}
+
+// newBackupFIFO creates a named pipe under os.TempDir() with the given prefix, so a
+// snapshot can be streamed between the file-path-based backup/restore library and a
+// BackupStore without ever landing as a complete file on local disk.
+func newBackupFIFO(prefix string) (string, error) {
+	fifoPath := path.Join(os.TempDir(), fmt.Sprintf("%v%v.fifo", prefix, time.Now().UTC().UnixNano()))
+	if err := syscall.Mkfifo(fifoPath, 0600); err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	return fifoPath, nil
+}
+
+// unblockFIFO briefly opens fifoPath with flag, the opposite end of a pending blocking
+// open, so a goroutine stuck opening it doesn't leak forever if the other side
+// (etcdBackup/etcdRestore) fails before ever touching the pipe.
+func unblockFIFO(fifoPath string, flag int) {
+	f, err := os.OpenFile(fifoPath, flag, 0)
+	if err != nil {
+		return
+	}
+	f.Close()
+}
+
+// etcdBackupToStore takes a snapshot and uploads it to the backup store addressed by
+// storeURL under name. etcdBackup only writes to a file path, so the snapshot is piped
+// through a named pipe directly into BackupStore.Put as it's produced, rather than being
+// staged on disk in full first.
+func etcdBackupToStore(ctx context.Context, storeURL, name string) error {
+	store, err := NewBackupStore(ctx, storeURL)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	fifoPath, err := newBackupFIFO("etcd-backup-")
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer os.Remove(fifoPath)
+
+	uploaded := make(chan error, 1)
+	go func() {
+		r, err := os.Open(fifoPath)
+		if err != nil {
+			uploaded <- trace.ConvertSystemError(err)
+			return
+		}
+		defer r.Close()
+		uploaded <- store.Put(ctx, name, r)
+	}()
+
+	if err := etcdBackup(fifoPath); err != nil {
+		unblockFIFO(fifoPath, os.O_WRONLY)
+		<-uploaded
+		return trace.Wrap(err)
+	}
+
+	if err := <-uploaded; err != nil {
+		return trace.Wrap(err, "failed to upload etcd backup to %v", storeURL)
+	}
+	log.Infof("Uploaded etcd backup %v to %v", name, storeURL)
+	return nil
+}
+
+// etcdRestoreFromStore downloads name from the backup store addressed by storeURL and
+// restores it. Since etcdRestore only reads from a file path, the download is streamed
+// through a named pipe directly into etcdRestore rather than staged on disk in full first.
+func etcdRestoreFromStore(ctx context.Context, storeURL, name string) error {
+	store, err := NewBackupStore(ctx, storeURL)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	src, err := store.Get(ctx, name)
+	if err != nil {
+		return trace.Wrap(err, "failed to download etcd backup %v from %v", name, storeURL)
+	}
+	defer src.Close()
+
+	fifoPath, err := newBackupFIFO("etcd-restore-")
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer os.Remove(fifoPath)
+
+	written := make(chan error, 1)
+	go func() {
+		w, err := os.OpenFile(fifoPath, os.O_WRONLY, 0)
+		if err != nil {
+			written <- trace.ConvertSystemError(err)
+			return
+		}
+		defer w.Close()
+		_, err = io.Copy(w, src)
+		written <- trace.ConvertSystemError(err)
+	}()
+
+	if err := etcdRestore(fifoPath); err != nil {
+		unblockFIFO(fifoPath, os.O_RDONLY)
+		<-written
+		return trace.Wrap(err)
+	}
+
+	if err := <-written; err != nil {
+		return trace.Wrap(err, "failed to stream etcd backup %v from %v", name, storeURL)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewBackupStoreSchemeDispatch(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		comment string
+		rawURL  string
+		wantErr bool
+	}{
+		{"bare path defaults to local disk", "/var/lib/etcd-backups", false},
+		{"file scheme", "file:///var/lib/etcd-backups", false},
+		{"unsupported scheme", "ftp://example.com/backups", true},
+	}
+	for _, tt := range tests {
+		store, err := NewBackupStore(ctx, tt.rawURL)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error, got nil", tt.comment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.comment, err)
+			continue
+		}
+		if _, ok := store.(*fileBackupStore); !ok {
+			t.Errorf("%v: got store of type %T, want *fileBackupStore", tt.comment, store)
+		}
+	}
+}
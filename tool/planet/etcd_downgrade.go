@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DowngradeMonitorInterval matches etcd's own downgrade monitor cadence; polling any
+	// faster just burns cycles without seeing newer information.
+	DowngradeMonitorInterval = 4 * time.Second
+	// DowngradeStorageVersionTimeout bounds how long etcdDowngrade waits for every
+	// member's StorageVersion to reach the target before declaring the downgrade failed.
+	// It must stay well above DowngradeMonitorInterval so a few slow ticks don't cause a
+	// false failure.
+	DowngradeStorageVersionTimeout = 2 * time.Minute
+	// DefaultEtcdDowngradePendingFile records the full release version a downgrade is
+	// targeting while it's in flight. It's kept separate from DefaultEtcdCurrentVersionFile
+	// so a mid-flight planet restart can resume the same downgrade without that file ever
+	// claiming a downgrade finished before the storage version actually moved.
+	DefaultEtcdDowngradePendingFile = "/ext/etcd/downgrade-pending"
+)
+
+// etcdDowngrade drives a downgrade of the etcd cluster to targetVersion using the native
+// Downgrade gRPC API introduced in etcd 3.5, rather than shuffling data directories:
+// it validates the downgrade, enables it, waits for every member's StorageVersion to
+// reach targetVersion's major.minor, then swaps this node's /usr/bin/etcd symlink (as
+// written by etcdInit) to the older binary and restarts etcd.
+//
+// The intended target is persisted to DefaultEtcdDowngradePendingFile before the cluster is
+// touched; it's only promoted to DefaultEtcdCurrentVersionFile once the binary has actually
+// been swapped, so a restart between validate/enable and the swap can't mistake an
+// in-progress downgrade for a completed one. resumePendingDowngrade, called from etcdInit,
+// is what actually drives a downgrade left in this state by a previous process back to
+// completion against the same target. etcdDowngrade refuses if any member is a learner, if
+// alarms are raised, or if targetVersion is more than one minor version behind the current
+// version recorded in this node's DefaultEtcdCurrentVersionFile.
+func etcdDowngrade(ctx context.Context, targetVersion string) error {
+	if err := downgradePreCheck(ctx, targetVersion); err != nil {
+		return trace.Wrap(err)
+	}
+
+	storageTarget, err := majorMinorString(targetVersion)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := writePendingDowngradeTarget(targetVersion); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := etcdctlRun(ctx, "downgrade", "validate", storageTarget); err != nil {
+		return trace.Wrap(err, "downgrade to %v failed validation", storageTarget)
+	}
+
+	if err := etcdctlRun(ctx, "downgrade", "enable", storageTarget); err != nil {
+		return trace.Wrap(err, "failed to enable downgrade to %v", storageTarget)
+	}
+
+	if err := waitForStorageVersion(ctx, storageTarget); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := swapEtcdBinary(targetVersion); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := writeEtcdEnvironment(DefaultEtcdCurrentVersionFile, targetVersion, ""); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := clearPendingDowngradeTarget(); err != nil {
+		log.WithError(err).Warn("Failed to clear pending downgrade marker")
+	}
+
+	log.Infof("etcd downgrade to %v complete", targetVersion)
+	return nil
+}
+
+// writePendingDowngradeTarget records targetVersion as the in-flight downgrade target.
+func writePendingDowngradeTarget(targetVersion string) error {
+	if err := os.MkdirAll(filepath.Dir(DefaultEtcdDowngradePendingFile), 0700); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	return trace.ConvertSystemError(ioutil.WriteFile(DefaultEtcdDowngradePendingFile, []byte(targetVersion), 0600))
+}
+
+// clearPendingDowngradeTarget removes the in-flight downgrade marker once a downgrade has
+// completed.
+func clearPendingDowngradeTarget() error {
+	err := os.Remove(DefaultEtcdDowngradePendingFile)
+	if err != nil && !os.IsNotExist(err) {
+		return trace.ConvertSystemError(err)
+	}
+	return nil
+}
+
+// resumePendingDowngrade looks for a downgrade target left behind by writePendingDowngradeTarget
+// from a previous process and, if one is found, drives it to completion. It's called from
+// etcdInit so a planet restart in the middle of a downgrade (after validate/enable but before
+// the binary swap and DefaultEtcdCurrentVersionFile update) continues against the same target
+// instead of silently losing track of it and leaving the cluster's storage version ahead of
+// what DefaultEtcdCurrentVersionFile claims. Failure to resume is logged rather than returned:
+// etcd may not be reachable yet this early in planet startup, and etcdInit's own symlink
+// bookkeeping must not be blocked on that - a failed resume just means the downgrade needs to
+// be retried explicitly.
+func resumePendingDowngrade(ctx context.Context) {
+	data, err := ioutil.ReadFile(DefaultEtcdDowngradePendingFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("Failed to read pending etcd downgrade marker")
+		}
+		return
+	}
+
+	target := strings.TrimSpace(string(data))
+	if target == "" {
+		return
+	}
+
+	log.Warnf("Resuming etcd downgrade to %v left in flight by a previous run", target)
+	if err := etcdDowngrade(ctx, target); err != nil {
+		log.WithError(err).Warnf("Failed to resume etcd downgrade to %v, it will need to be retried", target)
+	}
+}
+
+// downgradePreCheck refuses the downgrade if any member is a learner, the cluster has
+// active alarms, or targetVersion is more than one minor version behind current.
+func downgradePreCheck(ctx context.Context, targetVersion string) error {
+	if err := checkNoAlarms(ctx); err != nil {
+		return trace.Wrap(err)
+	}
+
+	client, err := newClusterV3Client()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer client.Close()
+
+	members, err := listClusterMembers(ctx, client)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, m := range members {
+		if m.IsLearner {
+			return trace.BadParameter("refusing to downgrade: member %v is a learner", m.Name)
+		}
+	}
+
+	currentVersion, _, err := readEtcdVersion(DefaultEtcdCurrentVersionFile)
+	if err != nil {
+		if !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		currentVersion = AssumeEtcdVersion
+	}
+
+	ok, err := withinOneMinor(currentVersion, targetVersion)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !ok {
+		return trace.BadParameter("refusing to downgrade from %v to %v: more than one minor version apart", currentVersion, targetVersion)
+	}
+
+	return nil
+}
+
+// withinOneMinor reports whether target is the same or exactly one minor version behind
+// current, within the same major version.
+func withinOneMinor(current, target string) (bool, error) {
+	curMajor, curMinor, err := majorMinor(current)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	tgtMajor, tgtMinor, err := majorMinor(target)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	if curMajor != tgtMajor {
+		return false, nil
+	}
+	diff := curMinor - tgtMinor
+	return diff >= 0 && diff <= 1, nil
+}
+
+func majorMinor(version string) (major int, minor int, err error) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, trace.BadParameter("invalid etcd version %q", version)
+	}
+	major, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, trace.Wrap(err, "invalid etcd version %q", version)
+	}
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, trace.Wrap(err, "invalid etcd version %q", version)
+	}
+	return major, minor, nil
+}
+
+// majorMinorString renders version's major.minor component, which is the form etcd's
+// native downgrade API and its StorageVersion status field use (e.g. "3.4"), as opposed to
+// the patch-qualified release versions (e.g. "3.4.18") this codebase tracks elsewhere.
+func majorMinorString(version string) (string, error) {
+	major, minor, err := majorMinor(version)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return fmt.Sprintf("%d.%d", major, minor), nil
+}
+
+// waitForStorageVersion polls every member's status until all report StorageVersion ==
+// target (a major.minor string, as produced by majorMinorString), or
+// DowngradeStorageVersionTimeout elapses. A member reporting no StorageVersion at all is
+// treated as "still migrating" rather than an error, since older members only populate the
+// field once the downgrade has actually started taking effect.
+func waitForStorageVersion(ctx context.Context, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, DowngradeStorageVersionTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(DowngradeMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		ready, err := storageVersionReached(ctx, target)
+		if err != nil {
+			log.WithError(err).Warn("Failed to check etcd storage version, retrying")
+		} else if ready {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err(), "timed out waiting for storage version to reach %v", target)
+		case <-ticker.C:
+		}
+	}
+}
+
+// storageVersionReached reports whether every member in the cluster reports
+// StorageVersion == target.
+func storageVersionReached(ctx context.Context, target string) (bool, error) {
+	var entries []endpointStatusEntry
+	if err := etcdctlJSON(ctx, &entries, "endpoint", "status", "--cluster"); err != nil {
+		return false, trace.Wrap(err)
+	}
+	if len(entries) == 0 {
+		return false, nil
+	}
+	for _, e := range entries {
+		if e.Status.StorageVersion != target {
+			// empty StorageVersion or a stale value both mean "still migrating"
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// swapEtcdBinary points /usr/bin/etcd and /usr/bin/etcdctl (as set up by etcdInit) at the
+// given version and restarts the local etcd service.
+func swapEtcdBinary(version string) error {
+	if err := etcdDisable(false); err != nil {
+		return trace.Wrap(err)
+	}
+
+	for _, p := range []string{"/usr/bin/etcd", "/usr/bin/etcdctl"} {
+		_ = os.Remove(p)
+		if err := os.Symlink(fmt.Sprint(p, "-", version), p); err != nil {
+			return trace.ConvertSystemError(err)
+		}
+	}
+
+	return trace.Wrap(etcdEnable(false))
+}
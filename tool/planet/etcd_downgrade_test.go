@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestMajorMinorString(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{version: "3.4.18", want: "3.4"},
+		{version: "3.5.6", want: "3.5"},
+		{version: "3", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := majorMinorString(tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("majorMinorString(%q): expected an error, got nil", tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("majorMinorString(%q): unexpected error: %v", tt.version, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("majorMinorString(%q) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestWithinOneMinor(t *testing.T) {
+	tests := []struct {
+		comment string
+		current string
+		target  string
+		want    bool
+	}{
+		{"same version", "3.4.18", "3.4.18", true},
+		{"one minor behind", "3.4.18", "3.3.22", true},
+		{"two minors behind", "3.5.6", "3.3.22", false},
+		{"different major", "3.4.18", "2.9.9", false},
+		{"ahead instead of behind", "3.3.22", "3.4.18", false},
+	}
+	for _, tt := range tests {
+		got, err := withinOneMinor(tt.current, tt.target)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.comment, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v: withinOneMinor(%q, %q) = %v, want %v", tt.comment, tt.current, tt.target, got, tt.want)
+		}
+	}
+}
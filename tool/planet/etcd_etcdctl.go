@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultEtcdctlBinary is the path etcdInit symlinks to the active etcdctl version, so
+// shelling out here always talks to the binary matching the running etcd.
+const DefaultEtcdctlBinary = "/usr/bin/etcdctl"
+
+// etcdctlCommand builds an etcdctl invocation against the local cluster, using the same
+// endpoint as etcdBackup and the same TLS material as etcdBackup/etcdRestore, with the v3
+// API enabled.
+func etcdctlCommand(ctx context.Context, args ...string) *exec.Cmd {
+	baseArgs := []string{
+		"--endpoints", DefaultEtcdEndpoints,
+		"--cert", DefaultEtcdctlCertFile,
+		"--key", DefaultEtcdctlKeyFile,
+		"--cacert", DefaultEtcdctlCAFile,
+	}
+	cmd := exec.CommandContext(ctx, DefaultEtcdctlBinary, append(baseArgs, args...)...)
+	cmd.Env = append(cmd.Env, "ETCDCTL_API=3")
+	return cmd
+}
+
+// etcdctlJSON runs an etcdctl subcommand with --write-out=json and unmarshals the result
+// into out.
+func etcdctlJSON(ctx context.Context, out interface{}, args ...string) error {
+	cmd := etcdctlCommand(ctx, append(args, "--write-out=json")...)
+	data, err := cmd.Output()
+	if err != nil {
+		return trace.Wrap(err, "etcdctl %v failed: %v", strings.Join(args, " "), exitErrOutput(err))
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return trace.Wrap(err, "failed to parse etcdctl output")
+	}
+	return nil
+}
+
+// etcdctlRun runs an etcdctl subcommand and logs its combined output, for commands like
+// `downgrade validate` / `downgrade enable` that don't produce JSON worth parsing.
+func etcdctlRun(ctx context.Context, args ...string) error {
+	cmd := etcdctlCommand(ctx, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return trace.Wrap(err, "etcdctl %v failed: %v", strings.Join(args, " "), string(out))
+	}
+	log.Infof("etcdctl %v: %v", strings.Join(args, " "), string(out))
+	return nil
+}
+
+// exitErrOutput extracts stderr from an *exec.ExitError, if that's what err is.
+func exitErrOutput(err error) string {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(exitErr.Stderr)
+	}
+	return ""
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// MigrationVerifyTimeout bounds how long migrationVerify waits for a migrated member to
+// report the target version before the migration is considered failed.
+const MigrationVerifyTimeout = 2 * time.Minute
+
+// Migration describes a single version-to-version etcd upgrade step. resolveMigrationPath
+// composes registered Migrations to support multi-hop upgrades without special-casing
+// each (from, to) pair.
+type Migration struct {
+	// From is the etcd version this migration starts from.
+	From string
+	// To is the etcd version this migration ends on.
+	To string
+	// PreCheck verifies the cluster is in a state where the migration can safely start.
+	PreCheck func(ctx context.Context) error
+	// Apply performs the migration itself.
+	Apply func(ctx context.Context) error
+	// Verify confirms the migration completed successfully.
+	Verify func(ctx context.Context) error
+	// Rollback undoes a failed Apply; invoked automatically when Verify fails.
+	Rollback func(ctx context.Context) error
+}
+
+// SupportedVersions lists the etcd versions planet knows how to run, in upgrade order.
+// Multi-hop upgrades (e.g. 3.3.x -> 3.5.x) are resolved by chaining the registered
+// single-hop Migrations between consecutive supported versions.
+var SupportedVersions = []string{
+	AssumeEtcdVersion,
+	"3.3.22",
+	"3.4.18",
+	"3.5.6",
+}
+
+type migrationKey struct{ From, To string }
+
+// migrationRegistry maps a single hop (From,To) to the Migration that performs it.
+var migrationRegistry = map[migrationKey]Migration{}
+
+func init() {
+	for i := 0; i+1 < len(SupportedVersions); i++ {
+		from, to := SupportedVersions[i], SupportedVersions[i+1]
+		migrationRegistry[migrationKey{From: from, To: to}] = newDataDirMigration(from, to)
+	}
+}
+
+// newDataDirMigration builds the standard Migration for a single-hop etcd version swap,
+// wrapping the existing disable/upgrade/enable primitives with generic pre-flight checks
+// and post-swap verification, rolling back automatically on verification failure.
+func newDataDirMigration(from, to string) Migration {
+	// preMigrationRevision is captured by PreCheck and read back by Verify, giving Verify a
+	// floor the post-migration revision must not have fallen below.
+	var preMigrationRevision int64
+
+	return Migration{
+		From: from,
+		To:   to,
+		PreCheck: func(ctx context.Context) error {
+			if err := migrationPreCheck(ctx, to); err != nil {
+				return trace.Wrap(err)
+			}
+			revision, err := currentRevision(ctx)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			preMigrationRevision = revision
+			return nil
+		},
+		Apply: func(ctx context.Context) error {
+			if err := etcdDisable(false); err != nil {
+				return trace.Wrap(err)
+			}
+			if err := etcdUpgrade(false, to); err != nil {
+				return trace.Wrap(err)
+			}
+			return trace.Wrap(etcdEnable(false))
+		},
+		Verify: func(ctx context.Context) error {
+			return trace.Wrap(migrationVerify(ctx, to, preMigrationRevision))
+		},
+		Rollback: func(ctx context.Context) error {
+			if err := etcdDisable(false); err != nil {
+				return trace.Wrap(err)
+			}
+			if err := etcdUpgrade(true, from); err != nil {
+				return trace.Wrap(err)
+			}
+			return trace.Wrap(etcdEnable(false))
+		},
+	}
+}
+
+// resolveMigrationPath composes the registered single-hop Migrations between from and to,
+// walking SupportedVersions in order, so a multi-hop upgrade doesn't need a dedicated
+// entry in migrationRegistry.
+func resolveMigrationPath(from, to string) ([]Migration, error) {
+	if !isSupportedVersion(to) {
+		return nil, trace.BadParameter("%v is not a supported etcd version", to)
+	}
+
+	fromIdx, toIdx := -1, -1
+	for i, v := range SupportedVersions {
+		if v == from {
+			fromIdx = i
+		}
+		if v == to {
+			toIdx = i
+		}
+	}
+	if fromIdx < 0 {
+		return nil, trace.BadParameter("%v is not a supported etcd version", from)
+	}
+	if fromIdx > toIdx {
+		return nil, trace.BadParameter("downgrading from %v to %v is not supported by the migrator", from, to)
+	}
+
+	var path []Migration
+	for i := fromIdx; i < toIdx; i++ {
+		key := migrationKey{From: SupportedVersions[i], To: SupportedVersions[i+1]}
+		m, ok := migrationRegistry[key]
+		if !ok {
+			return nil, trace.NotFound("no registered migration from %v to %v", key.From, key.To)
+		}
+		path = append(path, m)
+	}
+	return path, nil
+}
+
+// etcdMigrateTo drives the table-driven migrator from the current etcd version to
+// targetVersion, running each hop's PreCheck, Apply and Verify in turn and invoking
+// Rollback automatically if Verify fails.
+func etcdMigrateTo(ctx context.Context, targetVersion string) error {
+	currentVersion, _, err := readEtcdVersion(DefaultEtcdCurrentVersionFile)
+	if err != nil {
+		if !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		currentVersion = AssumeEtcdVersion
+	}
+
+	hops, err := resolveMigrationPath(currentVersion, targetVersion)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	for _, m := range hops {
+		log.Infof("Migrating etcd %v -> %v", m.From, m.To)
+
+		if err := m.PreCheck(ctx); err != nil {
+			return trace.Wrap(err, "pre-flight check failed for %v -> %v", m.From, m.To)
+		}
+
+		if err := m.Apply(ctx); err != nil {
+			return trace.Wrap(err, "failed to apply migration %v -> %v", m.From, m.To)
+		}
+
+		if err := m.Verify(ctx); err != nil {
+			log.WithError(err).Warnf("Migration %v -> %v failed verification, rolling back", m.From, m.To)
+			if rerr := m.Rollback(ctx); rerr != nil {
+				return trace.NewAggregate(err, rerr)
+			}
+			return trace.Wrap(err, "migration %v -> %v failed verification and was rolled back", m.From, m.To)
+		}
+	}
+
+	return nil
+}
+
+func isSupportedVersion(version string) bool {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// migrationPreCheck verifies disk space, cluster health and alarm state before a
+// migration hop is applied.
+func migrationPreCheck(ctx context.Context, to string) error {
+	if !isSupportedVersion(to) {
+		return trace.BadParameter("%v is not a supported etcd version", to)
+	}
+	if err := checkDiskSpace(); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := checkMembersHealthy(ctx); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := checkNoAlarms(ctx); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// checkDiskSpace verifies the filesystem backing the etcd store has at least twice the
+// size of the current data directory free, enough room for the new version's data
+// directory to be built up alongside the old one during the migration.
+func checkDiskSpace() error {
+	dataDir := path.Join(DefaultEtcdStoreBase, "latest", "member")
+	size, err := dirSize(dataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return trace.ConvertSystemError(err)
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(DefaultEtcdStoreBase, &stat); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+
+	if available < 2*size {
+		return trace.BadParameter("insufficient disk space for migration: need %v bytes free, have %v", 2*size, available)
+	}
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// checkMembersHealthy refuses the migration if any cluster member is currently unhealthy.
+func checkMembersHealthy(ctx context.Context) error {
+	var health []struct {
+		Endpoint string `json:"endpoint"`
+		Health   bool   `json:"health"`
+	}
+	if err := etcdctlJSON(ctx, &health, "endpoint", "health", "--cluster"); err != nil {
+		return trace.Wrap(err)
+	}
+	for _, h := range health {
+		if !h.Health {
+			return trace.BadParameter("etcd member %v is not healthy", h.Endpoint)
+		}
+	}
+	return nil
+}
+
+// checkNoAlarms refuses the migration if the cluster has any active alarms (e.g. NOSPACE).
+func checkNoAlarms(ctx context.Context) error {
+	var resp struct {
+		Alarms []interface{} `json:"alarms"`
+	}
+	if err := etcdctlJSON(ctx, &resp, "alarm", "list"); err != nil {
+		return trace.Wrap(err)
+	}
+	if len(resp.Alarms) > 0 {
+		return trace.BadParameter("etcd cluster has %v active alarm(s), refusing to migrate", len(resp.Alarms))
+	}
+	return nil
+}
+
+type endpointStatusEntry struct {
+	Endpoint string `json:"Endpoint"`
+	Status   struct {
+		Version        string `json:"version"`
+		StorageVersion string `json:"storageVersion"`
+		RaftIndex      int64  `json:"raftIndex"`
+		RaftTerm       int64  `json:"raftTerm"`
+		Header         struct {
+			MemberID uint64 `json:"member_id"`
+			Revision int64  `json:"revision"`
+		} `json:"header"`
+	} `json:"Status"`
+}
+
+// currentRevision returns the local member's current revision, as reported by endpoint
+// status, for migrationVerify to use as a floor the post-migration revision must reach.
+func currentRevision(ctx context.Context) (int64, error) {
+	var entries []endpointStatusEntry
+	if err := etcdctlJSON(ctx, &entries, "endpoint", "status"); err != nil {
+		return 0, trace.Wrap(err)
+	}
+	if len(entries) == 0 {
+		return 0, trace.NotFound("no endpoint status entries returned")
+	}
+	return entries[0].Status.Header.Revision, nil
+}
+
+// migrationVerify polls the local member until it reports the target version, has rejoined
+// the cluster as a full (non-learner) member, and its revision has reached at least
+// minRevision (the revision captured before the hop's Apply ran, so a migration that came up
+// with an empty or stale data directory doesn't pass), or times out after
+// MigrationVerifyTimeout.
+func migrationVerify(ctx context.Context, to string, minRevision int64) error {
+	ctx, cancel := context.WithTimeout(ctx, MigrationVerifyTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(WaitInterval)
+	defer ticker.Stop()
+
+	for {
+		ok, err := migrationVerifyOnce(ctx, to, minRevision)
+		if err != nil {
+			log.WithError(err).Warn("Failed to verify etcd migration, retrying")
+		} else if ok {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err(), "etcd did not come up on version %v in time", to)
+		case <-ticker.C:
+		}
+	}
+}
+
+// migrationVerifyOnce checks the local member's version, revision and cluster membership
+// against the criteria described on migrationVerify, a single time.
+func migrationVerifyOnce(ctx context.Context, to string, minRevision int64) (bool, error) {
+	var entries []endpointStatusEntry
+	if err := etcdctlJSON(ctx, &entries, "endpoint", "status"); err != nil {
+		return false, trace.Wrap(err)
+	}
+	if len(entries) == 0 {
+		return false, nil
+	}
+	status := entries[0].Status
+	if status.Version != to || status.Header.Revision < minRevision {
+		return false, nil
+	}
+
+	client, err := newClusterV3Client()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	defer client.Close()
+
+	members, err := listClusterMembers(ctx, client)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	for _, m := range members {
+		if m.ID == status.Header.MemberID {
+			return !m.IsLearner, nil
+		}
+	}
+	return false, nil
+}
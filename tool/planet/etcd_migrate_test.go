@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestResolveMigrationPath(t *testing.T) {
+	tests := []struct {
+		comment string
+		from    string
+		to      string
+		wantErr bool
+		hops    []string // "From->To" pairs, in order
+	}{
+		{
+			comment: "single hop",
+			from:    "3.4.18",
+			to:      "3.5.6",
+			hops:    []string{"3.4.18->3.5.6"},
+		},
+		{
+			comment: "multi-hop",
+			from:    AssumeEtcdVersion,
+			to:      "3.5.6",
+			hops:    []string{AssumeEtcdVersion + "->3.3.22", "3.3.22->3.4.18", "3.4.18->3.5.6"},
+		},
+		{
+			comment: "already at target",
+			from:    "3.5.6",
+			to:      "3.5.6",
+			hops:    nil,
+		},
+		{
+			comment: "unsupported target",
+			from:    "3.4.18",
+			to:      "4.0.0",
+			wantErr: true,
+		},
+		{
+			comment: "unsupported source",
+			from:    "2.9.9",
+			to:      "3.5.6",
+			wantErr: true,
+		},
+		{
+			comment: "downgrade direction is not supported by the migrator",
+			from:    "3.5.6",
+			to:      "3.4.18",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		path, err := resolveMigrationPath(tt.from, tt.to)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error, got nil", tt.comment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.comment, err)
+			continue
+		}
+		if len(path) != len(tt.hops) {
+			t.Errorf("%v: got %v hops, want %v", tt.comment, len(path), len(tt.hops))
+			continue
+		}
+		for i, m := range path {
+			got := m.From + "->" + m.To
+			if got != tt.hops[i] {
+				t.Errorf("%v: hop %v = %v, want %v", tt.comment, i, got, tt.hops[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gravitational/trace"
+)
+
+const (
+	// DefaultAgentRPCPort is the port planet-agent listens on for the internal control API
+	// that etcdUpgradeCluster uses to drive the disable/upgrade/enable sequence on remote
+	// members of the etcd cluster.
+	DefaultAgentRPCPort = 7577
+	// etcdUpgradeStagePath is the planet-agent endpoint that runs a single
+	// disable/upgrade/enable stage of etcdUpgradeCluster on the node it's called against.
+	etcdUpgradeStagePath = "/etcd/upgrade-stage"
+)
+
+// etcdUpgradeStage names one of the three steps etcdUpgradeCluster drives on a member.
+type etcdUpgradeStage string
+
+const (
+	stageDisable etcdUpgradeStage = "disable"
+	stageUpgrade etcdUpgradeStage = "upgrade"
+	stageEnable  etcdUpgradeStage = "enable"
+)
+
+// etcdUpgradeStageRequest is the body of a POST to etcdUpgradeStagePath, naming which stage
+// to run and, for stageUpgrade, whether it's a rollback.
+type etcdUpgradeStageRequest struct {
+	Stage    etcdUpgradeStage `json:"stage"`
+	Rollback bool             `json:"rollback,omitempty"`
+}
+
+// runRemoteEtcdStage dispatches one etcdUpgradeCluster stage to the planet-agent running on
+// member m, over the same mTLS material used to reach etcd itself, rather than running it
+// against the local node. The coordinator calls this for every member, including itself, so
+// there is a single code path regardless of which node happens to be leading the rollout.
+// The counterpart planet-agent endpoint runs the request by calling etcdDisable, etcdUpgrade
+// or etcdEnable directly on its own node.
+func runRemoteEtcdStage(ctx context.Context, m ClusterMember, stage etcdUpgradeStage, rollback bool) error {
+	tlsConfig, err := loadClientTLSConfig(DefaultEtcdctlCertFile, DefaultEtcdctlKeyFile, DefaultEtcdctlCAFile)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	body, err := json.Marshal(etcdUpgradeStageRequest{Stage: stage, Rollback: rollback})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	url := fmt.Sprintf("https://%v:%v%v", memberHost(m), DefaultAgentRPCPort, etcdUpgradeStagePath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return trace.Wrap(err, "failed to reach planet-agent on %v to run %v stage", m.Name, stage)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return trace.BadParameter("planet-agent on %v rejected %v stage: %v", m.Name, stage, resp.Status)
+	}
+	return nil
+}
+
+// handleEtcdUpgradeStage is the planet-agent-side handler for etcdUpgradeStagePath: it runs
+// the requested disable/upgrade/enable stage against this node's own etcd and replies with
+// the result, so a remote coordinator running etcdUpgradeCluster can drive every member of
+// the cluster without assuming direct filesystem/systemd access to them.
+func handleEtcdUpgradeStage(w http.ResponseWriter, req *http.Request) {
+	var stageReq etcdUpgradeStageRequest
+	if err := json.NewDecoder(req.Body).Decode(&stageReq); err != nil {
+		http.Error(w, trace.Wrap(err, "failed to decode upgrade-stage request").Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch stageReq.Stage {
+	case stageDisable:
+		err = etcdDisable(false)
+	case stageUpgrade:
+		err = etcdUpgrade(stageReq.Rollback, "")
+	case stageEnable:
+		err = etcdEnable(false)
+	default:
+		http.Error(w, fmt.Sprintf("unknown etcd upgrade stage %q", stageReq.Stage), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// memberHost returns the bare host (no port) a member advertises its etcd client URL on, so
+// the agent RPC can be dialed on DefaultAgentRPCPort instead of the etcd client port.
+func memberHost(m ClusterMember) string {
+	host, _, err := net.SplitHostPort(m.Endpoint)
+	if err != nil {
+		return m.Endpoint
+	}
+	return host
+}
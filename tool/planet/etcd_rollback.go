@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultEtcdRollbackDir is the directory rollbackcopy snapshots are stored under.
+	DefaultEtcdRollbackDir = "/ext/etcd/rollback"
+	// DefaultMaxRollbackCopies is the number of rollbackcopy snapshots retained by default.
+	DefaultMaxRollbackCopies = 3
+)
+
+// rollbackRevision records the etcd revision observed by the pre-upgrade health probe, so
+// etcdRollback can report what state a rollback copy was taken at.
+type rollbackRevision struct {
+	Revision  int64     `json:"revision"`
+	MemberID  string    `json:"memberId"`
+	ClusterID string    `json:"clusterId"`
+	Captured  time.Time `json:"captured"`
+}
+
+// etcdRollbackCopy snapshots the currently-running member's data directory, current
+// version marker and a revision.json capturing the last revision seen by a health probe,
+// into a new timestamped directory under DefaultEtcdRollbackDir. It's meant to run
+// immediately before etcdUpgrade wipes the data directory for the desired version, giving
+// operators a fast local path back to the pre-upgrade state via etcdRollback.
+func etcdRollbackCopy(ctx context.Context, currentVersion string) (string, error) {
+	srcDir := path.Join(getBaseEtcdDir(currentVersion), "member")
+	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+		log.Info("No existing etcd member directory, nothing to copy for rollback")
+		return "", nil
+	}
+
+	dest := path.Join(DefaultEtcdRollbackDir, fmt.Sprintf("%v-%v", time.Now().UTC().Format("20060102-150405"), currentVersion))
+	log.Infof("Creating rollback copy of %v at %v", srcDir, dest)
+
+	if err := copyDir(srcDir, path.Join(dest, "member")); err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	// etcdUpgrade has already rewritten DefaultEtcdCurrentVersionFile to the upgrade target by
+	// now, so the marker is written from currentVersion rather than copied from that file.
+	if err := writeEtcdEnvironment(path.Join(dest, "version.txt"), currentVersion, ""); err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	if revision, err := probeEtcdRevision(ctx); err != nil {
+		log.WithError(err).Warn("Failed to probe etcd revision for rollback copy, continuing without revision.json")
+	} else {
+		data, err := json.Marshal(revision)
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dest, "revision.json"), data, 0600); err != nil {
+			return "", trace.ConvertSystemError(err)
+		}
+	}
+
+	if err := pruneRollbackCopies(DefaultEtcdRollbackDir, DefaultMaxRollbackCopies); err != nil {
+		log.WithError(err).Warn("Failed to prune old rollback copies")
+	}
+
+	return dest, nil
+}
+
+// probeEtcdRevision queries the local member's status and returns the revision it is
+// currently serving, for recording alongside a rollback copy.
+func probeEtcdRevision(ctx context.Context) (*rollbackRevision, error) {
+	var entries []struct {
+		Status struct {
+			Header struct {
+				ClusterID uint64 `json:"cluster_id"`
+				MemberID  uint64 `json:"member_id"`
+				Revision  int64  `json:"revision"`
+			} `json:"header"`
+		} `json:"Status"`
+	}
+	if err := etcdctlJSON(ctx, &entries, "endpoint", "status"); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(entries) == 0 {
+		return nil, trace.NotFound("no endpoint status entries returned")
+	}
+	header := entries[0].Status.Header
+	return &rollbackRevision{
+		Revision:  header.Revision,
+		MemberID:  fmt.Sprint(header.MemberID),
+		ClusterID: fmt.Sprint(header.ClusterID),
+		Captured:  time.Now().UTC(),
+	}, nil
+}
+
+// pruneRollbackCopies removes the oldest rollback copies under dir until at most maxCopies
+// remain. Copy directories are named <timestamp>-<version>, so lexical order is chronological.
+func pruneRollbackCopies(dir string, maxCopies int) error {
+	copies, err := listRollbackCopies(dir)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(copies) <= maxCopies {
+		return nil
+	}
+	for _, name := range copies[:len(copies)-maxCopies] {
+		copyDir := path.Join(dir, name)
+		if err := os.RemoveAll(copyDir); err != nil {
+			return trace.ConvertSystemError(err)
+		}
+		log.Infof("Removed old rollback copy: %v", copyDir)
+	}
+	return nil
+}
+
+// listRollbackCopies returns the names of rollback copy directories under dir, oldest first.
+func listRollbackCopies(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, trace.ConvertSystemError(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// resolveRollbackCopy picks the rollback copy whose name matches the timestamp prefix to
+// among copies (as returned by listRollbackCopies) and splits out the version it was taken
+// at, so etcdRollback can be pointed at the right directory and binary symlink target.
+func resolveRollbackCopy(copies []string, to string) (name, version string, err error) {
+	for _, n := range copies {
+		if strings.HasPrefix(n, to) {
+			name = n
+			break
+		}
+	}
+	if name == "" {
+		return "", "", trace.NotFound("no rollback copy found matching %q", to)
+	}
+
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) != 3 {
+		return "", "", trace.BadParameter("unexpected rollback copy name %q", name)
+	}
+	if _, err := time.Parse("20060102-150405", parts[0]+"-"+parts[1]); err != nil {
+		return "", "", trace.BadParameter("unexpected rollback copy name %q", name)
+	}
+	return name, parts[2], nil
+}
+
+// etcdRollback stops etcd, restores the rollback copy matching the given timestamp
+// (a prefix of a directory name under DefaultEtcdRollbackDir) by swapping the symlinks
+// written by etcdInit, and starts etcd back up.
+func etcdRollback(ctx context.Context, to string) error {
+	copies, err := listRollbackCopies(DefaultEtcdRollbackDir)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	match, version, err := resolveRollbackCopy(copies, to)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	src := path.Join(DefaultEtcdRollbackDir, match)
+
+	log.Infof("Rolling back etcd to %v (version %v)", match, version)
+
+	if err := disableService(ctx, ETCDServiceName); err != nil {
+		return trace.Wrap(err)
+	}
+
+	destDir := getBaseEtcdDir(version)
+	if err := os.RemoveAll(path.Join(destDir, "member")); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	if err := copyDir(path.Join(src, "member"), path.Join(destDir, "member")); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := copyFile(path.Join(src, "version.txt"), DefaultEtcdCurrentVersionFile); err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+
+	latestDir := path.Join(DefaultEtcdStoreBase, "latest")
+	_ = os.Remove(latestDir)
+	if err := os.Symlink(destDir, latestDir); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+
+	// Repoint /usr/bin/etcd and /usr/bin/etcdctl at the rollback target's version, the same
+	// way etcdInit and swapEtcdBinary do, so enableService below starts the binary that
+	// matches the data directory just restored rather than whatever was linked before.
+	for _, p := range []string{"/usr/bin/etcd", "/usr/bin/etcdctl"} {
+		_ = os.Remove(p)
+		if err := os.Symlink(fmt.Sprint(p, "-", version), p); err != nil {
+			return trace.ConvertSystemError(err)
+		}
+	}
+
+	return trace.Wrap(enableService(ctx, ETCDServiceName))
+}
+
+// copyDir recursively copies src to dst, creating directories as needed.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		return copyFile(p, target)
+	})
+}
+
+// copyFile copies the contents and mode of src to dst, creating dst's parent directory
+// if necessary.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return trace.ConvertSystemError(err)
+}
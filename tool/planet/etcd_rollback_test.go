@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResolveRollbackCopy(t *testing.T) {
+	copies := []string{
+		"20260101-010101-3.4.18",
+		"20260102-020202-3.5.6",
+	}
+
+	t.Run("matches by timestamp prefix", func(t *testing.T) {
+		name, version, err := resolveRollbackCopy(copies, "20260102")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if name != "20260102-020202-3.5.6" || version != "3.5.6" {
+			t.Errorf("got (%q, %q), want (%q, %q)", name, version, "20260102-020202-3.5.6", "3.5.6")
+		}
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		if _, _, err := resolveRollbackCopy(copies, "19990101"); err == nil {
+			t.Error("expected an error, got nil")
+		}
+	})
+
+	t.Run("malformed copy name", func(t *testing.T) {
+		if _, _, err := resolveRollbackCopy([]string{"not-a-valid-name"}, "not"); err == nil {
+			t.Error("expected an error, got nil")
+		}
+	})
+}
+
+func TestListAndPruneRollbackCopies(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"20260101-010101-3.3.22",
+		"20260102-020202-3.4.18",
+		"20260103-030303-3.5.6",
+	}
+	for _, name := range names {
+		if err := os.Mkdir(path.Join(dir, name), 0700); err != nil {
+			t.Fatalf("failed to seed rollback copy %v: %v", name, err)
+		}
+	}
+
+	got, err := listRollbackCopies(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != len(names) {
+		t.Fatalf("got %v copies, want %v: %v", len(got), len(names), got)
+	}
+
+	if err := pruneRollbackCopies(dir, 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	remaining, err := listRollbackCopies(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("got %v remaining copies, want 2: %v", len(remaining), remaining)
+	}
+	for _, name := range remaining {
+		if name == names[0] {
+			t.Errorf("oldest copy %v should have been pruned", names[0])
+		}
+	}
+}
+
+func TestListRollbackCopiesMissingDir(t *testing.T) {
+	copies, err := listRollbackCopies(path.Join(t.TempDir(), "does-not-exist"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if copies != nil {
+		t.Errorf("got %v, want nil for a missing rollback dir", copies)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// fakeBackupStore is an in-memory BackupStore used to exercise nextBackupDelay and
+// pruneOldBackups without touching local disk or an object store.
+type fakeBackupStore struct {
+	names   []string // oldest first, matching BackupStore.List's contract
+	deleted []string
+}
+
+func (f *fakeBackupStore) Put(ctx context.Context, name string, r io.Reader) error {
+	f.names = append(f.names, name)
+	return nil
+}
+
+func (f *fakeBackupStore) List(ctx context.Context) ([]string, error) {
+	return f.names, nil
+}
+
+func (f *fakeBackupStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return nil, trace.NotFound("%v not found", name)
+}
+
+func (f *fakeBackupStore) Delete(ctx context.Context, name string) error {
+	f.deleted = append(f.deleted, name)
+	var remaining []string
+	for _, n := range f.names {
+		if n != name {
+			remaining = append(remaining, n)
+		}
+	}
+	f.names = remaining
+	return nil
+}
+
+func TestNextBackupDelay(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("empty store backs up immediately", func(t *testing.T) {
+		store := &fakeBackupStore{}
+		delay, err := nextBackupDelay(ctx, store, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if delay != 0 {
+			t.Errorf("delay = %v, want 0", delay)
+		}
+	})
+
+	t.Run("recent snapshot pushes out the next run", func(t *testing.T) {
+		name := "etcd-backup-" + time.Now().UTC().Format(backupSnapshotNameLayout) + ".bak"
+		store := &fakeBackupStore{names: []string{name}}
+		delay, err := nextBackupDelay(ctx, store, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if delay <= 0 || delay > time.Hour {
+			t.Errorf("delay = %v, want within (0, 1h]", delay)
+		}
+	})
+
+	t.Run("stale snapshot backs up immediately", func(t *testing.T) {
+		stale := time.Now().UTC().Add(-2 * time.Hour).Format(backupSnapshotNameLayout)
+		store := &fakeBackupStore{names: []string{"etcd-backup-" + stale + ".bak"}}
+		delay, err := nextBackupDelay(ctx, store, time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if delay != 0 {
+			t.Errorf("delay = %v, want 0", delay)
+		}
+	})
+}
+
+func TestPruneOldBackups(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeBackupStore{names: []string{"etcd-backup-1.bak", "etcd-backup-2.bak", "etcd-backup-3.bak"}}
+
+	if err := pruneOldBackups(ctx, store, 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(store.names) != 2 {
+		t.Fatalf("got %v remaining backups, want 2: %v", len(store.names), store.names)
+	}
+	if len(store.deleted) != 1 || store.deleted[0] != "etcd-backup-1.bak" {
+		t.Errorf("deleted = %v, want [etcd-backup-1.bak]", store.deleted)
+	}
+}
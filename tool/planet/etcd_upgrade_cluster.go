@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	clientv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ClusterUpgradeElectionKey is the etcd key campaigned on to elect the node that
+	// coordinates an upgrade-cluster run, so only one node drives the rollout at a time.
+	ClusterUpgradeElectionKey = "/planet/etcd-upgrade-cluster/leader"
+	// MemberCatchUpTimeout bounds how long upgrade-cluster waits for a just-upgraded
+	// member to rejoin as a full voting member at the cluster's raft index.
+	MemberCatchUpTimeout = 2 * time.Minute
+	// RaftIndexThreshold is how far behind the cluster's highest raft index an upgraded
+	// member may be while still being considered caught up.
+	RaftIndexThreshold = 10
+)
+
+// ClusterMember is a member of the etcd cluster as seen by etcdUpgradeCluster.
+type ClusterMember struct {
+	ID        uint64
+	Name      string
+	Endpoint  string
+	IsLearner bool
+}
+
+// etcdUpgradeCluster coordinates a rolling upgrade of every member of the etcd cluster
+// reachable at DefaultEtcdEndpoints. One node is elected leader via an etcd lease and
+// rolls the upgrade member by member, dispatching disable/upgrade/enable to each member's
+// planet-agent over runRemoteEtcdStage (so the coordinator never assumes it's running on
+// the member it's currently upgrading), then waits for the member to rejoin as a full
+// voter at the cluster's raft index with no alarms raised before moving on. If taking the
+// next member down would lose quorum, the coordinator refuses and returns a structured
+// error instead of proceeding. With dryRun set, it only prints the planned order and a
+// health snapshot.
+func etcdUpgradeCluster(ctx context.Context, dryRun bool) error {
+	client, err := newClusterV3Client()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer client.Close()
+
+	members, err := listClusterMembers(ctx, client)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if dryRun {
+		log.Info("Planned etcd upgrade-cluster order:")
+		for i, m := range members {
+			log.Infof("  %v. %v (%v) learner=%v", i+1, m.Name, m.Endpoint, m.IsLearner)
+		}
+		var health []struct {
+			Endpoint string `json:"endpoint"`
+			Health   bool   `json:"health"`
+		}
+		if err := etcdctlJSON(ctx, &health, "endpoint", "health", "--cluster"); err != nil {
+			return trace.Wrap(err)
+		}
+		log.Info("Current etcd endpoint health:")
+		for _, h := range health {
+			log.Infof("  %v healthy=%v", h.Endpoint, h.Health)
+		}
+		return checkNoAlarms(ctx)
+	}
+
+	session, err := concurrency.NewSession(client)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, ClusterUpgradeElectionKey)
+	if err := election.Campaign(ctx, "upgrade-cluster"); err != nil {
+		return trace.Wrap(err, "failed to become upgrade-cluster leader")
+	}
+	defer election.Resign(context.Background())
+
+	for i, m := range members {
+		if err := guardQuorum(ctx, len(members)); err != nil {
+			return trace.Wrap(err, "refusing to upgrade member %v", m.Name)
+		}
+
+		log.Infof("Upgrading etcd member %v/%v: %v (%v)", i+1, len(members), m.Name, m.Endpoint)
+
+		if err := runRemoteEtcdStage(ctx, m, stageDisable, false); err != nil {
+			return trace.Wrap(err)
+		}
+		if err := runRemoteEtcdStage(ctx, m, stageUpgrade, false); err != nil {
+			return trace.Wrap(err)
+		}
+		if err := runRemoteEtcdStage(ctx, m, stageEnable, false); err != nil {
+			return trace.Wrap(err)
+		}
+
+		if err := waitForMemberCaughtUp(ctx, client, m); err != nil {
+			return trace.Wrap(err, "member %v did not rejoin cleanly after upgrade", m.Name)
+		}
+	}
+
+	log.Info("Cluster-wide etcd upgrade complete")
+	return nil
+}
+
+// guardQuorum refuses to proceed if taking one more member down would leave the cluster
+// below quorum.
+func guardQuorum(ctx context.Context, total int) error {
+	var health []struct {
+		Endpoint string `json:"endpoint"`
+		Health   bool   `json:"health"`
+	}
+	if err := etcdctlJSON(ctx, &health, "endpoint", "health", "--cluster"); err != nil {
+		return trace.Wrap(err)
+	}
+
+	down := 0
+	for _, h := range health {
+		if !h.Health {
+			down++
+		}
+	}
+
+	return checkQuorumAfterRemoving(total, down)
+}
+
+// checkQuorumAfterRemoving reports whether taking one more member down, given down members
+// out of total are already unhealthy, would leave the cluster at or above quorum.
+func checkQuorumAfterRemoving(total, down int) error {
+	quorum := total/2 + 1
+	remaining := total - down - 1
+	if remaining < quorum {
+		return trace.BadParameter(
+			"taking another member down would leave %v of %v members up, below quorum of %v (%v already down)",
+			remaining, total, quorum, down)
+	}
+	return nil
+}
+
+// waitForMemberCaughtUp polls m's status until it is no longer a learner and its raft
+// index is within RaftIndexThreshold of the cluster's highest, with no active alarms.
+func waitForMemberCaughtUp(ctx context.Context, client *clientv3.Client, m ClusterMember) error {
+	ctx, cancel := context.WithTimeout(ctx, MemberCatchUpTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(WaitInterval)
+	defer ticker.Stop()
+
+	for {
+		ok, err := memberCaughtUp(ctx, client, m)
+		if err == nil && ok {
+			return checkNoAlarms(ctx)
+		}
+		if err != nil {
+			log.WithError(err).Warnf("Failed to check status of member %v, retrying", m.Name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// memberCaughtUp reports whether m has rejoined the cluster as a full voter with a raft
+// index within RaftIndexThreshold of the cluster maximum.
+func memberCaughtUp(ctx context.Context, client *clientv3.Client, m ClusterMember) (bool, error) {
+	members, err := listClusterMembers(ctx, client)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	for _, member := range members {
+		if member.ID == m.ID && member.IsLearner {
+			return false, nil
+		}
+	}
+
+	var entries []endpointStatusEntry
+	if err := etcdctlJSON(ctx, &entries, "endpoint", "status", "--cluster"); err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	var maxIndex, memberIndex int64
+	found := false
+	for _, e := range entries {
+		if e.Status.RaftIndex > maxIndex {
+			maxIndex = e.Status.RaftIndex
+		}
+		// listClusterMembers strips the scheme from m.Endpoint; endpoint status keeps it
+		if strings.TrimPrefix(e.Endpoint, "https://") == m.Endpoint {
+			memberIndex = e.Status.RaftIndex
+			found = true
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	return maxIndex-memberIndex <= RaftIndexThreshold, nil
+}
+
+// listClusterMembers returns the cluster's current membership.
+func listClusterMembers(ctx context.Context, client *clientv3.Client) ([]ClusterMember, error) {
+	resp, err := client.MemberList(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	members := make([]ClusterMember, 0, len(resp.Members))
+	for _, member := range resp.Members {
+		endpoint := ""
+		if len(member.ClientURLs) > 0 {
+			endpoint = member.ClientURLs[0]
+		}
+		members = append(members, ClusterMember{
+			ID:        member.ID,
+			Name:      member.Name,
+			Endpoint:  strings.TrimPrefix(endpoint, "https://"),
+			IsLearner: member.IsLearner,
+		})
+	}
+	return members, nil
+}
+
+// newClusterV3Client builds a clientv3 client against DefaultEtcdEndpoints, using the
+// same TLS material as etcdBackup/etcdRestore/etcdctlCommand.
+func newClusterV3Client() (*clientv3.Client, error) {
+	tlsConfig, err := loadClientTLSConfig(DefaultEtcdctlCertFile, DefaultEtcdctlKeyFile, DefaultEtcdctlCAFile)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{DefaultEtcdEndpoints},
+		DialTimeout: EtcdUpgradeTimeout,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return client, nil
+}
+
+func loadClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, trace.BadParameter("failed to parse CA certificate %v", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
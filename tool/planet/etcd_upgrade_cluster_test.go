@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestMemberHost(t *testing.T) {
+	tests := []struct {
+		comment  string
+		endpoint string
+		want     string
+	}{
+		{"host and port", "10.0.0.5:2379", "10.0.0.5"},
+		{"bare host", "10.0.0.5", "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		got := memberHost(ClusterMember{Endpoint: tt.endpoint})
+		if got != tt.want {
+			t.Errorf("%v: memberHost(%q) = %q, want %q", tt.comment, tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestCheckQuorumAfterRemoving(t *testing.T) {
+	tests := []struct {
+		comment string
+		total   int
+		down    int
+		wantErr bool
+	}{
+		{"all healthy, 3-node cluster", 3, 0, false},
+		{"one already down, 3-node cluster", 3, 1, true},
+		{"all healthy, 5-node cluster", 5, 0, false},
+		{"one already down, 5-node cluster", 5, 1, false},
+		{"two already down, 5-node cluster", 5, 2, true},
+	}
+	for _, tt := range tests {
+		err := checkQuorumAfterRemoving(tt.total, tt.down)
+		if tt.wantErr && err == nil {
+			t.Errorf("%v: expected an error, got nil", tt.comment)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%v: expected no error, got %v", tt.comment, err)
+		}
+	}
+}